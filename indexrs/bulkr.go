@@ -5,24 +5,78 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type bulkIndexr struct {
-	buf        bytes.Buffer
-	bulkChan   chan []byte
-	errChan    chan error
-	stopChan   chan empty
-	routines   routinePool
-	timeout    int
-	terminated bool
+	buf             bytes.Buffer
+	bulkChan        chan bulkItem
+	errChan         chan error
+	doneChan        chan empty // closed by Stop to tell the Start loop to drain and exit
+	stoppedChan     chan empty // closed by the Start loop once it has exited
+	flushReq        chan chan empty
+	routines        routinePool
+	timeout         time.Duration
+	mu              sync.Mutex
+	terminated      bool
+	inflight        sync.WaitGroup // enqueue calls that passed the terminated check and may still be sending on bulkChan
+	transport       Transport
+	ignoredStatuses map[int]bool
+	backoff         Backoff
+	retryable       func(status int) bool
+	inFlightRetries int32
+	retryDrain      chan empty
+	items           [][]byte
+	refreshPending  bool // set if any buffered item since the last flush asked for refresh
+	itemRetryMax    int
+	itemRetryStatus map[int]bool
 }
 
+// bulkItem is a single formatted action(+data) pair handed from enqueue to
+// the Start loop, together with whether it asked for a refresh. refresh is
+// a whole-request option on the Elasticsearch bulk API, not a per-item one,
+// so a batch is POSTed with ?refresh=true if any item buffered into it
+// asked for one.
+type bulkItem struct {
+	bytes   []byte
+	refresh bool
+}
+
+// Backoff is the retry schedule applied when a bulk POST itself comes back
+// with a retryable status (429/503 by default). The delay for attempt n
+// (0-indexed) is min(Max, Initial*2^n) scaled by a random factor in
+// [0.5, 1.0); n resets to 0
+// after any successful flush.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	MaxRetries int
+}
+
+const (
+	// defaults used when SetBackoff has not been called
+	defaultBackoffInitial = 100 * time.Millisecond
+	defaultBackoffMax     = 30 * time.Second
+)
+
 // NewBulkIndexr
+// url is the base URL of the elasticsearch node (or load balancer) bulk requests are POSTed to
 // maxNumberOfConns is the number of http connections we can make to elasticsearch
 // Moreover, the maximum amount of runtime memory needed is maxNumberOfConns * bulkSize
 // The latter is because once we have the buffer full, we make a copy and send it. We make the copy to speed up things
-func NewBulkIndexr(maxNumberOfConns, bulkSize, timeout int) *bulkIndexr {
+func NewBulkIndexr(url string, maxNumberOfConns, bulkSize, timeout int) *bulkIndexr {
+	return NewBulkIndexrWithTransport(NewHTTPTransport(url), maxNumberOfConns, bulkSize, timeout)
+}
+
+// NewBulkIndexrWithTransport is NewBulkIndexr for callers that need a custom
+// Transport: a pool of more than one ES node, sniffing, auth headers, TLS,
+// or a mock transport in unit tests.
+func NewBulkIndexrWithTransport(transport Transport, maxNumberOfConns, bulkSize, timeout int) *bulkIndexr {
 	if timeout <= 0 {
 		timeout = DefaultTimeout
 	}
@@ -32,155 +86,585 @@ func NewBulkIndexr(maxNumberOfConns, bulkSize, timeout int) *bulkIndexr {
 	if maxNumberOfConns >= MaxNumberOfConnection {
 		maxNumberOfConns = MaxNumberOfConnection
 	}
-	return &bulkIndexr{
-		buf:        bytes.NewBuffer(make([]byte, bulkSize, 0)),
-		bulkChan:   make(chan []byte),
-		errChan:    make(chan error),
-		stopChan:   make(chan empty),
-		routines:   routinePool(maxNumberOfConns),
-		timeout:    timeout,
-		terminated: false,
+	bi := &bulkIndexr{
+		bulkChan:    make(chan bulkItem),
+		errChan:     make(chan error),
+		doneChan:    make(chan empty),
+		stoppedChan: make(chan empty),
+		flushReq:    make(chan chan empty),
+		routines:    newRoutinePool(maxNumberOfConns),
+		timeout:     time.Duration(timeout) * time.Millisecond,
+		transport:   transport,
+		retryDrain:  make(chan empty, maxNumberOfConns),
+	}
+	bi.buf.Grow(bulkSize)
+	return bi
+}
+
+// SetIgnoredStatuses configures per-item response statuses that should not
+// be surfaced as BulkErrors, e.g. 409 version conflicts when re-indexing
+// idempotent events. 400/429/5xx are always surfaced unless listed here.
+func (bi *bulkIndexr) SetIgnoredStatuses(codes ...int) {
+	ignored := make(map[int]bool, len(codes))
+	for _, c := range codes {
+		ignored[c] = true
+	}
+	bi.ignoredStatuses = ignored
+}
+
+// SetBackoff configures the exponential backoff applied when a bulk POST
+// comes back 429 or 503 (or whatever SetRetryClassifier decides is
+// retryable). maxRetries <= 0 means retry forever.
+func (bi *bulkIndexr) SetBackoff(initial, max time.Duration, maxRetries int) {
+	bi.backoff = Backoff{Initial: initial, Max: max, MaxRetries: maxRetries}
+}
+
+// SetRetryClassifier overrides which HTTP status codes from the bulk
+// endpoint are treated as retryable. Defaults to 429 and 503.
+func (bi *bulkIndexr) SetRetryClassifier(fn func(status int) bool) {
+	bi.retryable = fn
+}
+
+// SetItemRetry enables per-document retry: items whose individual response
+// status is in statuses (429 and 503 when statuses is empty) are rebuilt
+// into a smaller bulk batch and resubmitted, up to max times, instead of
+// failing the whole batch over one bad document. Failed items with any other
+// status surface as BulkErrors immediately.
+func (bi *bulkIndexr) SetItemRetry(max int, statuses []int) {
+	bi.itemRetryMax = max
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	}
+	retryable := make(map[int]bool, len(statuses))
+	for _, s := range statuses {
+		retryable[s] = true
+	}
+	bi.itemRetryStatus = retryable
+}
+
+func (bi *bulkIndexr) isRetryable(status int) bool {
+	if bi.retryable != nil {
+		return bi.retryable(status)
+	}
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// nextDelay implements delay_n = min(max, initial*2^n) * (0.5 + rand()*0.5).
+func (bi *bulkIndexr) nextDelay(attempt int) time.Duration {
+	initial := bi.backoff.Initial
+	if initial <= 0 {
+		initial = defaultBackoffInitial
+	}
+	max := bi.backoff.Max
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+	shift := uint(attempt)
+	if shift > 62 {
+		// Cap the shift itself so 1<<shift can't overflow int64; the
+		// multiply below is still checked in case initial is large.
+		shift = 62
 	}
+	delay := initial * time.Duration(int64(1)<<shift)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+	jitter := 0.5 + rand.Float64()*0.5
+	return time.Duration(float64(delay) * jitter)
 }
 
-// Index
+// waitForCapacity blocks Index/Delete/Update/Create while the number of
+// whole-batch send attempts in flight in sendWithBackoff (first tries and
+// retries alike) is at cap(retryDrain), i.e. maxNumberOfConns, so a degraded
+// ES cluster applies back-pressure to producers.
+func (bi *bulkIndexr) waitForCapacity() {
+	for atomic.LoadInt32(&bi.inFlightRetries) >= int32(cap(bi.retryDrain)) {
+		<-bi.retryDrain
+	}
+}
+
+// BulkMeta carries the per-item metadata fields the Elasticsearch bulk API
+// accepts on the action line (_ttl, _routing, _parent, _version, ...). Zero
+// values are omitted from the action line.
+type BulkMeta struct {
+	TTL             string
+	Routing         string
+	Parent          string
+	Version         int64
+	VersionType     string
+	RetryOnConflict int
+}
+
+// Index is the convenience wrapper for the common case: an "index" op with
+// no extra metadata. refresh requests that the batch this item ends up in
+// is POSTed with ?refresh=true, making it visible to search immediately
+// instead of waiting for the next index refresh interval. Use
+// IndexWithMeta, Delete, Update or Create when the full metadata surface is
+// needed.
 func (bi *bulkIndexr) Index(index, typ string, id string, refresh bool, data interface{}) error {
-	b, err := writeBulkBytes("index", index, typ, id, data)
+	return bi.enqueue("index", index, typ, id, BulkMeta{}, data, refresh)
+}
+
+// IndexWithMeta is Index with the full BulkMeta surface (TTL, routing,
+// parent, version, ...).
+func (bi *bulkIndexr) IndexWithMeta(index, typ, id string, data interface{}, meta BulkMeta) error {
+	return bi.enqueue("index", index, typ, id, meta, data, false)
+}
+
+// Delete enqueues a "delete" bulk op. Deletes carry no data payload.
+func (bi *bulkIndexr) Delete(index, typ, id string, meta BulkMeta) error {
+	return bi.enqueue("delete", index, typ, id, meta, nil, false)
+}
+
+// Update enqueues an "update" bulk op. doc is the partial document sent as
+// the payload line, wrapped as {"doc": doc} per the bulk API's update
+// format (http://www.elasticsearch.org/guide/reference/api/bulk.html).
+func (bi *bulkIndexr) Update(index, typ, id string, doc interface{}, meta BulkMeta) error {
+	return bi.enqueue("update", index, typ, id, meta, map[string]interface{}{"doc": doc}, false)
+}
+
+// Create enqueues a "create" bulk op, which fails instead of overwriting
+// when a document with the same id already exists.
+func (bi *bulkIndexr) Create(index, typ, id string, data interface{}, meta BulkMeta) error {
+	return bi.enqueue("create", index, typ, id, meta, data, false)
+}
+
+// enqueue formats op as bulk bytes and hands them off to the flush loop.
+// The terminated check and the inflight.Add must happen atomically together
+// (under mu) so Stop can't flip terminated and start closing bulkChan while
+// an enqueue call is about to send on it.
+func (bi *bulkIndexr) enqueue(op, index, typ, id string, meta BulkMeta, data interface{}, refresh bool) error {
+	bi.mu.Lock()
+	if bi.terminated {
+		bi.mu.Unlock()
+		return fmt.Errorf("goes: bulkIndexr is stopped")
+	}
+	bi.inflight.Add(1)
+	bi.mu.Unlock()
+	defer bi.inflight.Done()
+
+	b, err := writeBulkBytes(op, index, typ, id, meta, data)
 	if err != nil {
 		return err
 	}
-	if bi.terminated {
-		bi.stopChan <- empty{}
-	}
-	bi.bulkChan <- b
+	bi.waitForCapacity()
+	bi.bulkChan <- bulkItem{bytes: b, refresh: refresh}
 	return nil
 }
 
 func (bi *bulkIndexr) Start() {
-	if bi.terminated {
+	bi.mu.Lock()
+	terminated := bi.terminated
+	bi.mu.Unlock()
+	if terminated {
 		return
 	}
-	ticker := time.NewTicker(bi.timeout * time.Millisecond)
+	ticker := time.NewTicker(bi.timeout)
 	go func() {
+		defer ticker.Stop()
+		defer close(bi.stoppedChan)
 		for {
 			select {
-			case ticker.C:
+			case <-ticker.C:
 				bi.flush()
-			case b := <-bi.bulkChan:
-				if bi.buf.Len()+len(b) > bi.buf.Cap() {
+			case item := <-bi.bulkChan:
+				if bi.buf.Len()+len(item.bytes) > bi.buf.Cap() {
 					bi.flush()
 				}
-				_, err := bi.buf.Write(b)
+				_, err := bi.buf.Write(item.bytes)
 				if err != nil {
 					bi.errChan <- err
 				}
-			case <-bi.stopChan:
-				// signal back to stop func that we are done
-				// whatever was in buffer will be lost
-				bi.stopChan <- empty{}
-				break
+				bi.items = append(bi.items, item.bytes)
+				if item.refresh {
+					bi.refreshPending = true
+				}
+			case ack := <-bi.flushReq:
+				bi.flush()
+				close(ack)
+			case <-bi.doneChan:
+				// drain whatever is left before exiting so Stop doesn't lose data
+				bi.flush()
+				return
 			}
 		}
 	}()
 }
 
-// flush
+// Flush blocks until any buffered (not yet flushed) documents have been
+// handed off to send, so callers can observe a quiet point without Stopping.
+// It is a no-op once Stop has been called. Flush shares enqueue's
+// terminated/inflight guard so Stop can't close flushReq out from under a
+// Flush call that is already in flight.
+func (bi *bulkIndexr) Flush() {
+	bi.mu.Lock()
+	if bi.terminated {
+		bi.mu.Unlock()
+		return
+	}
+	bi.inflight.Add(1)
+	bi.mu.Unlock()
+	defer bi.inflight.Done()
+
+	ack := make(chan empty)
+	bi.flushReq <- ack
+	<-ack
+}
+
+// flush snapshots the current buffer into a freshly allocated []byte (the
+// underlying array of bi.buf is about to be reused by bi.buf.Reset, so a
+// shallow copy of the bytes.Buffer value would alias it) and hands that
+// snapshot, together with the per-document bytes collected alongside it, off
+// to a goroutine that sends it with backoff.
 func (bi *bulkIndexr) flush() {
 	if bi.buf.Len() == 0 {
 		return
 	}
 	bi.routines.next()
-	// create copy of buf
-	go func(buf bytes.Buffer) {
+	payload := make([]byte, bi.buf.Len())
+	copy(payload, bi.buf.Bytes())
+	items := bi.items
+	refresh := bi.refreshPending
+	go func(payload []byte, items [][]byte, refresh bool) {
 		defer bi.routines.add()
-		err := send(buf)
+		err := bi.sendWithBackoff(payload, items, refresh)
 		if err != nil {
 			bi.errChan <- err
 		}
 
-	}(bi.buf)
+	}(payload, items, refresh)
 	bi.buf.Reset()
+	bi.items = nil
+	bi.refreshPending = false
 }
 
-// This does the actual send of a buffer, which has already been formatted
-// into bytes of ES formatted bulk data
-func send(buf *bytes.Buffer) error {
-	type responseStruct struct {
-		Took   int64                    `json:"took"`
-		Errors bool                     `json:"errors"`
-		Items  []map[string]interface{} `json:"items"`
-	}
-
-	//response := responseStruct{}
-
-	//body, err := b.conn.DoCommand("POST", fmt.Sprintf("/_bulk?refresh=%t", b.Refresh), nil, buf)
-	//
-	//if err != nil {
-	//	return err
-	//}
-	//// check for response errors, bulk insert will give 200 OK but then include errors in response
-	//jsonErr := json.Unmarshal(body, &response)
-	//if jsonErr == nil {
-	//	if response.Errors {
-	//		// better parse the error message!!, this one sucks!
-	//		return fmt.Errorf("Bulk Insertion Error. Failed item count [%d]", len(response.Items))
-	//	}
-	//}
-	return nil
+// sendWithBackoff retries the same payload through send while the attempt
+// failed outright (a transport-level error: connection refused, DNS, a
+// timeout) or the response status is retryable, sleeping according to
+// Backoff between attempts. A transport-level error is retried the same as
+// a 503 rather than failing the batch on attempt 0, because Transport.Do
+// round-robins to a different node on every call: retrying here is what
+// actually lets the multi-node pool fail over instead of a single dead node
+// permanently failing the batch. It resets the attempt counter on success
+// and gives up after MaxRetries (if set), surfacing the last error. items
+// holds the original per-document bytes so a partial failure can be
+// narrowed down to just the offenders via retryFailedItems instead of
+// retrying (or failing) the whole batch.
+//
+// The between-attempt sleep races bi.doneChan, so a sustained 429/503 (the
+// default MaxRetries <= 0 means retry forever) can't make Stop's
+// routines.drain wait out the whole backoff schedule: once Stop closes
+// doneChan, any flush still retrying gives up on its next wakeup instead of
+// holding its routinePool token forever.
+func (bi *bulkIndexr) sendWithBackoff(payload []byte, items [][]byte, refresh bool) error {
+	for attempt := 0; ; attempt++ {
+		atomic.AddInt32(&bi.inFlightRetries, 1)
+		status, failed, err := bi.send(bytes.NewBuffer(payload), items, refresh)
+		atomic.AddInt32(&bi.inFlightRetries, -1)
+		select {
+		case bi.retryDrain <- empty{}:
+		default:
+		}
+
+		if err != nil || bi.isRetryable(status) {
+			if bi.backoff.MaxRetries > 0 && attempt >= bi.backoff.MaxRetries {
+				if err != nil {
+					return fmt.Errorf("bulk send: gave up after %d retries, last error: %v", attempt, err)
+				}
+				return fmt.Errorf("bulk send: gave up after %d retries, last status %d", attempt, status)
+			}
+			select {
+			case <-time.After(bi.nextDelay(attempt)):
+			case <-bi.doneChan:
+				return fmt.Errorf("bulk send: gave up after %d retries, bulkIndexr is stopping (last status %d, last error: %v)", attempt, status, err)
+			}
+			continue
+		}
+		if len(failed) > 0 && bi.itemRetryMax > 0 {
+			bi.retryFailedItems(failed, 0, refresh)
+		}
+		return nil
+	}
 }
 
-// Stop
-func (bi *bulkIndexr) Stop() {
-	bi.terminated = true
-	bi.stopChan <- empty{}
-	// we need to wait for the start dne signal
-	<-bi.stopChan
-	// we wait to see if Index still receiving data even after we call stop
-	// we we wait for second signal or until ticker timeout
-	ticker := time.NewTicker(500 * time.Millisecond)
-	// whatever happens first
+// itemFailure pairs a single item-level failure eligible for retry with the
+// original request bytes it came from (so it can be resubmitted) and the
+// *BulkError the cluster last reported for it (so, if retries run out, the
+// caller still gets the Index/Type/ID/Reason it needs to find the document
+// instead of a bare position into a batch that no longer exists).
+type itemFailure struct {
+	item []byte
+	err  *BulkError
+}
+
+// retryFailedItems rebuilds a bulk payload out of just the failed items and
+// resubmits it, recursing up to itemRetryMax times. Successful siblings are
+// never touched again; only the items still failing keep cycling. refresh
+// carries over from the batch these items originally failed in.
+//
+// retryFailedItems runs synchronously inside a flush goroutine that holds a
+// routinePool token, and Stop blocks on routines.drain until that token is
+// returned. The between-attempt sleep therefore races bi.doneChan the same
+// way sendWithBackoff's does, so Stop can't be made to wait out the whole
+// itemRetryMax*Backoff schedule against a sustained 429/503.
+func (bi *bulkIndexr) retryFailedItems(failed []itemFailure, attempt int, refresh bool) {
+	if attempt >= bi.itemRetryMax {
+		for _, f := range failed {
+			bi.errChan <- f.err
+		}
+		return
+	}
+
+	subItems := make([][]byte, len(failed))
+	var buf bytes.Buffer
+	for j, f := range failed {
+		subItems[j] = f.item
+		buf.Write(f.item)
+	}
+
 	select {
-	case <-bi.stopChan:
-	case <-ticker.C:
+	case <-time.After(bi.nextDelay(attempt)):
+	case <-bi.doneChan:
+		for _, f := range failed {
+			bi.errChan <- f.err
+		}
+		return
+	}
+
+	status, nextFailed, err := bi.send(&buf, subItems, refresh)
+	if err != nil {
+		bi.errChan <- err
+		return
+	}
+	if bi.isRetryable(status) {
+		// the retry batch itself was throttled rather than reporting
+		// per-item errors; the previous BulkErrors are still the most
+		// recent detail we have for these items
+		bi.retryFailedItems(failed, attempt+1, refresh)
+		return
+	}
+	if len(nextFailed) > 0 {
+		bi.retryFailedItems(nextFailed, attempt+1, refresh)
+	}
+}
+
+// BulkRequestError describes a whole-request bulk POST failure: a non-2xx
+// status that isn't retryable (400/401/403/404/413/500/...) and so is
+// neither retried by sendWithBackoff nor something a per-item parse of the
+// body can explain, since the body is whatever error payload the status
+// produced rather than a bulkResponse. It flows over the same errChan as
+// BulkError and transport-level errors.
+type BulkRequestError struct {
+	Status int
+	Body   string
+}
+
+func (e *BulkRequestError) Error() string {
+	return fmt.Sprintf("bulk request failed: status %d: %s", e.Status, e.Body)
+}
+
+// BulkError describes a single failed item from a bulk response. It
+// implements error so it can flow over the existing chan error returned by
+// ErrCh without breaking callers that only check for an error.
+type BulkError struct {
+	Index  string
+	Type   string
+	ID     string
+	Status int
+	Reason string
+	Op     string
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("bulk %s failed for %s/%s/%s: status %d: %s", e.Op, e.Index, e.Type, e.ID, e.Status, e.Reason)
+}
+
+type bulkItemResponse struct {
+	Index  string `json:"_index"`
+	Type   string `json:"_type"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Took   int64                         `json:"took"`
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkItemResponse `json:"items"`
+}
+
+// send POSTs a formatted bulk payload to /_bulk (or /_bulk?refresh=true if
+// refresh was requested by any item in the batch) and, for every item the
+// cluster rejected, either emits a *BulkError on errChan or, if item-level
+// retry is enabled and the item's status is retryable, returns an
+// itemFailure pairing its request bytes with that *BulkError (items must be
+// request-order-aligned with the response's items[]) so the caller can
+// resubmit just that subset and still report real diagnostic detail if
+// retries run out. A non-2xx status on the POST itself that isn't retryable
+// (400/401/403/404/413/500/...) emits a *BulkRequestError instead of being
+// parsed as a bulkResponse, since there are no per-item statuses to read out
+// of it. It also returns the HTTP status of the POST itself so
+// sendWithBackoff can decide whether to retry the whole batch.
+func (bi *bulkIndexr) send(buf *bytes.Buffer, items [][]byte, refresh bool) (int, []itemFailure, error) {
+	path := "/_bulk"
+	if refresh {
+		path += "?refresh=true"
 	}
+	resp, err := bi.transport.Do("POST", path, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
 
-	close(bi.stopChan)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	if bi.isRetryable(resp.StatusCode) {
+		return resp.StatusCode, nil, nil
+	}
+	if resp.StatusCode >= 300 {
+		bi.errChan <- &BulkRequestError{Status: resp.StatusCode, Body: string(body)}
+		return resp.StatusCode, nil, nil
+	}
+
+	var response bulkResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return resp.StatusCode, nil, err
+	}
+	if !response.Errors {
+		return resp.StatusCode, nil, nil
+	}
+
+	var failed []itemFailure
+	for i, item := range response.Items {
+		for op, detail := range item {
+			if detail.Error == nil || bi.ignoredStatuses[detail.Status] {
+				continue
+			}
+			bulkErr := &BulkError{
+				Index:  detail.Index,
+				Type:   detail.Type,
+				ID:     detail.ID,
+				Status: detail.Status,
+				Reason: detail.Error.Reason,
+				Op:     op,
+			}
+			if bi.itemRetryMax > 0 && i < len(items) && bi.itemRetryStatus[detail.Status] {
+				failed = append(failed, itemFailure{item: items[i], err: bulkErr})
+				continue
+			}
+			bi.errChan <- bulkErr
+		}
+	}
+	return resp.StatusCode, failed, nil
+}
+
+// Stop signals the Start loop to flush whatever is buffered and exit, then
+// waits for that drain to complete before closing the channels. Calling
+// Stop more than once is a no-op.
+//
+// A flush goroutine reporting a per-item failure or giving up after
+// exhausting item retries sends on errChan synchronously, while still
+// holding its routinePool token, so routines.drain() below can't return
+// until every such send has been received. Without a reader, that would
+// make Stop hang forever against a caller that isn't concurrently draining
+// ErrCh(). Stop runs its own drain for the duration of routines.drain() so
+// it never blocks on this regardless of what the caller is doing; any error
+// it consumes instead of a concurrent ErrCh() reader is inherent to
+// draining a channel with two readers and only matters for errors reported
+// right at shutdown.
+func (bi *bulkIndexr) Stop() {
+	bi.mu.Lock()
+	if bi.terminated {
+		bi.mu.Unlock()
+		return
+	}
+	bi.terminated = true
+	bi.mu.Unlock()
+
+	// wait for any enqueue that already passed the terminated check to
+	// finish its send before we let the Start loop exit and close bulkChan
+	bi.inflight.Wait()
+
+	close(bi.doneChan)
+	<-bi.stoppedChan
+
+	stopDrain := make(chan empty)
+	go func() {
+		defer close(stopDrain)
+		for range bi.errChan {
+		}
+	}()
+	bi.routines.drain()
 	close(bi.errChan)
+	<-stopDrain
+
 	close(bi.bulkChan)
+	close(bi.flushReq)
 	bi.routines.stop()
 }
 
 func (bi *bulkIndexr) ErrCh() chan error {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
 	if bi.terminated {
 		return nil
 	}
 	return bi.errChan
 }
 
+// bulkAction is the per-item action line of a bulk request, e.g.
+// {"index":{"_index":"...","_type":"...","_id":"...","_ttl":"1d"}}
+// Fields are marshalled through encoding/json so index/type/id/meta values
+// containing quotes, backslashes or unicode can never corrupt the request.
+type bulkAction struct {
+	Index           string `json:"_index"`
+	Type            string `json:"_type"`
+	ID              string `json:"_id,omitempty"`
+	TTL             string `json:"_ttl,omitempty"`
+	Routing         string `json:"_routing,omitempty"`
+	Parent          string `json:"_parent,omitempty"`
+	Version         int64  `json:"_version,omitempty"`
+	VersionType     string `json:"_version_type,omitempty"`
+	RetryOnConflict int    `json:"_retry_on_conflict,omitempty"`
+}
+
 // WriteBulkBytes
 // http://www.elasticsearch.org/guide/reference/api/bulk.html
-func writeBulkBytes(op string, index, typ, id string, data interface{}) ([]byte, error) {
-	// First line
-	buf := bytes.NewBuffer([]bytes{})
-	buf.WriteString(fmt.Sprintf(`{"%s":{`, op))
-	buf.WriteString(fmt.Sprintf(`{"%s":{"_index":"`, op))
-	buf.WriteString(index)
-	buf.WriteString(`","_type":"`)
-	buf.WriteString(typ)
-	buf.WriteString(`"`)
-	if len(id) > 0 {
-		buf.WriteString(`,"_id":"`)
-		buf.WriteString(id)
-		buf.WriteString(`"`)
-	}
-
-	buf.WriteString(`}}`)
+func writeBulkBytes(op string, index, typ, id string, meta BulkMeta, data interface{}) ([]byte, error) {
+	action := bulkAction{
+		Index:           index,
+		Type:            typ,
+		ID:              id,
+		TTL:             meta.TTL,
+		Routing:         meta.Routing,
+		Parent:          meta.Parent,
+		Version:         meta.Version,
+		VersionType:     meta.VersionType,
+		RetryOnConflict: meta.RetryOnConflict,
+	}
+	header, err := json.Marshal(map[string]bulkAction{op: action})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(header)
 	buf.WriteRune('\n')
 
+	// delete ops carry no data payload line
+	if op == "delete" {
+		return buf.Bytes(), nil
+	}
+
 	// data payload
 	switch v := data.(type) {
 	case *bytes.Buffer:
-		_, err := io.Copy(&buf, v)
+		_, err := io.Copy(buf, v)
 		if err != nil {
 			return nil, err
 		}
@@ -199,8 +683,7 @@ func writeBulkBytes(op string, index, typ, id string, data interface{}) ([]byte,
 		if err != nil {
 			return nil, err
 		}
-		_, err := buf.Write(body)
-		if err != nil {
+		if _, err := buf.Write(body); err != nil {
 			return nil, err
 		}
 	}
@@ -0,0 +1,681 @@
+package goes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTransport records every bulk payload it receives and always answers
+// with a clean "no errors" response, so tests can assert on call counts and
+// bodies without a real Elasticsearch cluster.
+type fakeTransport struct {
+	mu     sync.Mutex
+	bodies [][]byte
+	paths  []string
+}
+
+func (f *fakeTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.bodies = append(f.bodies, b)
+	f.paths = append(f.paths, path)
+	f.mu.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"took":1,"errors":false,"items":[]}`)),
+	}, nil
+}
+
+func (f *fakeTransport) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.bodies)
+}
+
+func newTestBulkIndexr(transport *fakeTransport, bulkSize, timeoutMillis int) *bulkIndexr {
+	return NewBulkIndexrWithTransport(transport, 4, bulkSize, timeoutMillis)
+}
+
+func TestBulkIndexrFlushOnCapExceeded(t *testing.T) {
+	transport := &fakeTransport{}
+	bi := newTestBulkIndexr(transport, 16, DefaultTimeout)
+	bi.Start()
+
+	// Each bulk item (action line plus document) is 49 bytes, too large for
+	// two to share the buffer, so the second and the third item each force a
+	// flush of the item before them, and Flush sends the last one.
+	for i := 0; i < 3; i++ {
+		if err := bi.Index("idx", "doc", "", false, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Index: %v", err)
+		}
+	}
+	bi.Flush()
+	bi.Stop()
+
+	if got := transport.callCount(); got < 2 {
+		t.Fatalf("expected at least 2 flushes (cap-exceeded + final), got %d", got)
+	}
+}
+
+func TestBulkIndexrFlushOnTick(t *testing.T) {
+	transport := &fakeTransport{}
+	bi := newTestBulkIndexr(transport, 1<<20, 20)
+	bi.Start()
+
+	if err := bi.Index("idx", "doc", "1", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	// count before Stop, whose own drain would flush the item anyway
+	got := transport.callCount()
+	bi.Stop()
+
+	if got < 1 {
+		t.Fatalf("expected the ticker to flush at least once, got %d calls", got)
+	}
+}
+
+func TestBulkIndexrGracefulDrainOnStop(t *testing.T) {
+	transport := &fakeTransport{}
+	bi := newTestBulkIndexr(transport, 1<<20, DefaultTimeout)
+	bi.Start()
+
+	for i := 0; i < 5; i++ {
+		if err := bi.Index("idx", "doc", "", false, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Index: %v", err)
+		}
+	}
+	bi.Stop()
+
+	if got := transport.callCount(); got != 1 {
+		t.Fatalf("expected Stop to drain the buffered batch in one flush, got %d calls", got)
+	}
+	if err := bi.Index("idx", "doc", "", false, []byte(`{"a":1}`)); err == nil {
+		t.Fatal("expected Index after Stop to return an error")
+	}
+}
+
+func TestBulkIndexrIndexRefreshSetsQueryParam(t *testing.T) {
+	transport := &fakeTransport{}
+	bi := newTestBulkIndexr(transport, 1<<20, DefaultTimeout)
+	bi.Start()
+
+	if err := bi.Index("idx", "doc", "1", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+	if err := bi.Index("idx", "doc", "2", true, []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Stop()
+
+	transport.mu.Lock()
+	paths := append([]string(nil), transport.paths...)
+	transport.mu.Unlock()
+
+	if len(paths) != 2 {
+		t.Fatalf("expected 2 POSTs, got %d: %q", len(paths), paths)
+	}
+	if paths[0] != "/_bulk" {
+		t.Fatalf("expected the non-refresh batch to POST to /_bulk, got %q", paths[0])
+	}
+	if paths[1] != "/_bulk?refresh=true" {
+		t.Fatalf("expected the refresh batch to POST to /_bulk?refresh=true, got %q", paths[1])
+	}
+}
+
+func TestBulkIndexrUpdateWrapsDocAndDeleteHasNoPayload(t *testing.T) {
+	transport := &fakeTransport{}
+	bi := newTestBulkIndexr(transport, 1<<20, DefaultTimeout)
+	bi.Start()
+
+	if err := bi.Create("idx", "doc", "1", map[string]interface{}{"foo": "bar"}, BulkMeta{}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := bi.Update("idx", "doc", "1", map[string]interface{}{"foo": "bar"}, BulkMeta{}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := bi.Delete("idx", "doc", "1", BulkMeta{}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	bi.Stop()
+
+	lines := splitBulkLines(t, transport.bodies)
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines (create: action+data, update: action+data, delete: action), got %d: %q", len(lines), lines)
+	}
+
+	// Create: data line is the bare document.
+	assertJSONEqual(t, lines[1], map[string]interface{}{"foo": "bar"})
+
+	// Update: data line must be wrapped as {"doc": ...} per the bulk API.
+	assertJSONEqual(t, lines[3], map[string]interface{}{"doc": map[string]interface{}{"foo": "bar"}})
+
+	// Delete: action line only, no data line follows it before the next action.
+	var deleteAction map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[4]), &deleteAction); err != nil {
+		t.Fatalf("delete action line is not valid JSON: %v", err)
+	}
+	if _, ok := deleteAction["delete"]; !ok {
+		t.Fatalf("expected a \"delete\" action line, got %q", lines[4])
+	}
+}
+
+// splitBulkLines concatenates every payload the transport received and
+// splits it into its newline-delimited bulk lines.
+func splitBulkLines(t *testing.T, bodies [][]byte) []string {
+	t.Helper()
+	var all []byte
+	for _, b := range bodies {
+		all = append(all, b...)
+	}
+	var lines []string
+	for _, l := range bytes.Split(bytes.TrimRight(all, "\n"), []byte("\n")) {
+		lines = append(lines, string(l))
+	}
+	return lines
+}
+
+func assertJSONEqual(t *testing.T, line string, want interface{}) {
+	t.Helper()
+	var got interface{}
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		t.Fatalf("line %q is not valid JSON: %v", line, err)
+	}
+	wantBytes, _ := json.Marshal(want)
+	gotBytes, _ := json.Marshal(got)
+	if string(wantBytes) != string(gotBytes) {
+		t.Fatalf("got %s, want %s", gotBytes, wantBytes)
+	}
+}
+
+// mixedErrorTransport always answers 200 OK with a fixed response body
+// reporting one ignored-status item failure and one non-ignored one, so
+// tests can assert on exactly which errors reach errChan.
+type mixedErrorTransport struct{}
+
+func (mixedErrorTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	resp := `{"took":1,"errors":true,"items":[` +
+		`{"index":{"_index":"idx","_type":"doc","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception","reason":"conflict"}}},` +
+		`{"index":{"_index":"idx","_type":"doc","_id":"2","status":400,"error":{"type":"mapper_parsing_exception","reason":"bad mapping"}}}` +
+		`]}`
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+	}, nil
+}
+
+func TestBulkIndexrSetIgnoredStatusesFiltersBulkErrors(t *testing.T) {
+	bi := NewBulkIndexrWithTransport(mixedErrorTransport{}, 4, 1<<20, DefaultTimeout)
+	bi.SetIgnoredStatuses(http.StatusConflict)
+	bi.Start()
+
+	if err := bi.Index("idx", "doc", "1", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	if err := bi.Index("idx", "doc", "2", false, []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	var gotErr error
+	select {
+	case gotErr = <-bi.errChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the non-ignored item failure to reach errChan")
+	}
+
+	bulkErr, ok := gotErr.(*BulkError)
+	if !ok {
+		t.Fatalf("expected a *BulkError, got %T: %v", gotErr, gotErr)
+	}
+	if bulkErr.ID != "2" || bulkErr.Status != 400 || bulkErr.Reason != "bad mapping" {
+		t.Fatalf("expected the 400 on doc 2 to surface, got %+v", bulkErr)
+	}
+
+	select {
+	case extra := <-bi.errChan:
+		t.Fatalf("expected the ignored 409 on doc 1 to be filtered out, got %v", extra)
+	default:
+	}
+
+	bi.Stop()
+}
+
+// wholeRequestErrorTransport always answers a non-retryable, non-2xx status
+// with a plain-text body, so tests can assert such a response surfaces a
+// *BulkRequestError instead of being parsed as a bulkResponse.
+type wholeRequestErrorTransport struct {
+	status int
+	body   string
+}
+
+func (tr wholeRequestErrorTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	return &http.Response{
+		StatusCode: tr.status,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(tr.body)),
+	}, nil
+}
+
+func TestBulkIndexrWholeRequestErrorSurfacesBulkRequestError(t *testing.T) {
+	transport := wholeRequestErrorTransport{status: http.StatusBadRequest, body: "malformed bulk request"}
+	bi := NewBulkIndexrWithTransport(transport, 4, 1<<20, DefaultTimeout)
+	bi.Start()
+
+	if err := bi.Index("idx", "doc", "1", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	var gotErr error
+	select {
+	case gotErr = <-bi.errChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the whole-request 400 to reach errChan")
+	}
+
+	reqErr, ok := gotErr.(*BulkRequestError)
+	if !ok {
+		t.Fatalf("expected a *BulkRequestError, got %T: %v", gotErr, gotErr)
+	}
+	if reqErr.Status != http.StatusBadRequest || reqErr.Body != "malformed bulk request" {
+		t.Fatalf("expected the 400 and its body to surface, got %+v", reqErr)
+	}
+
+	bi.Stop()
+}
+
+func TestBulkIndexrConcurrentIndexAndStop(t *testing.T) {
+	transport := &fakeTransport{}
+	bi := newTestBulkIndexr(transport, 4096, DefaultTimeout)
+	bi.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Errors are expected once Stop wins the race; only panics or
+			// deadlocks (caught by -race and the test timeout) are failures.
+			_ = bi.Index("idx", "doc", "", false, []byte(`{"a":1}`))
+		}()
+	}
+
+	go bi.Stop()
+	wg.Wait()
+}
+
+// always503Transport simulates a cluster that never recovers, so any retry
+// loop with the default (unlimited) MaxRetries never stops on its own.
+type always503Transport struct{}
+
+func (always503Transport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+	}, nil
+}
+
+// flakyConnTransport fails the first failFor calls with a plain connection
+// error (no HTTP round trip at all), then answers 200 OK with no errors.
+type flakyConnTransport struct {
+	mu      sync.Mutex
+	failFor int
+	calls   int
+}
+
+func (f *flakyConnTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	f.mu.Lock()
+	f.calls++
+	shouldFail := f.calls <= f.failFor
+	f.mu.Unlock()
+	if shouldFail {
+		return nil, fmt.Errorf("dial tcp: connection refused")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"took":1,"errors":false,"items":[]}`)),
+	}, nil
+}
+
+func TestBulkIndexrRetriesTransportErrorInsteadOfFailingOutright(t *testing.T) {
+	transport := &flakyConnTransport{failFor: 2}
+	bi := NewBulkIndexrWithTransport(transport, 4, 1<<20, DefaultTimeout)
+	bi.SetBackoff(time.Millisecond, 5*time.Millisecond, 0)
+	bi.Start()
+
+	go func() {
+		for range bi.errChan {
+		}
+	}()
+
+	if err := bi.Index("idx", "doc", "", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		transport.mu.Lock()
+		calls := transport.calls
+		transport.mu.Unlock()
+		if calls >= 3 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("expected the connection error to be retried until it succeeded (>= 3 calls), got %d", calls)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	bi.Stop()
+}
+
+// alwaysItemFailureTransport answers 200 OK but reports the single bulk item
+// as having failed with a status that SetItemRetry is configured to retry,
+// so retryFailedItems keeps recursing until itemRetryMax runs out (or Stop
+// interrupts it), rather than the whole-batch retry loop in sendWithBackoff
+// taking over.
+type alwaysItemFailureTransport struct{}
+
+func (alwaysItemFailureTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	resp := `{"took":1,"errors":true,"items":[{"index":{"_index":"idx","_type":"doc","_id":"1","status":429,"error":{"type":"es_rejected_execution_exception","reason":"rejected"}}}]}`
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+	}, nil
+}
+
+// onceFailingItemTransport reports item 0 as failing with a retryable
+// status on its first call, and as succeeding on every call after, so tests
+// can assert retryFailedItems actually rebuilds and resubmits a smaller
+// batch rather than just exercising the exhaustion path.
+type onceFailingItemTransport struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (o *onceFailingItemTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	o.mu.Lock()
+	o.calls++
+	first := o.calls == 1
+	o.mu.Unlock()
+	if first {
+		resp := `{"took":1,"errors":true,"items":[{"index":{"_index":"idx","_type":"doc","_id":"1","status":429,"error":{"type":"es_rejected_execution_exception","reason":"rejected"}}}]}`
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"took":1,"errors":false,"items":[]}`)),
+	}, nil
+}
+
+func TestBulkIndexrItemRetryRebuildsAndResubmitsFailedItems(t *testing.T) {
+	transport := &onceFailingItemTransport{}
+	bi := NewBulkIndexrWithTransport(transport, 4, 1<<20, DefaultTimeout)
+	bi.SetBackoff(time.Millisecond, time.Millisecond, 0)
+	bi.SetItemRetry(3, []int{429})
+	bi.Start()
+
+	go func() {
+		for range bi.errChan {
+		}
+	}()
+
+	if err := bi.Index("idx", "doc", "1", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		transport.mu.Lock()
+		calls := transport.calls
+		transport.mu.Unlock()
+		if calls >= 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("expected the failed item to be rebuilt into a second, smaller batch and resubmitted, got %d calls", calls)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	bi.Stop()
+}
+
+func TestBulkIndexrItemRetryExhaustionReportsBulkError(t *testing.T) {
+	bi := NewBulkIndexrWithTransport(alwaysItemFailureTransport{}, 4, 1<<20, DefaultTimeout)
+	bi.SetBackoff(time.Millisecond, time.Millisecond, 0)
+	bi.SetItemRetry(2, []int{429})
+	bi.Start()
+
+	if err := bi.Index("idx", "doc", "1", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	var gotErr error
+	select {
+	case gotErr = <-bi.errChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an error on errChan once item retries were exhausted")
+	}
+	bi.Stop()
+
+	bulkErr, ok := gotErr.(*BulkError)
+	if !ok {
+		t.Fatalf("expected a *BulkError once retries were exhausted, got %T: %v", gotErr, gotErr)
+	}
+	if bulkErr.Index != "idx" || bulkErr.Type != "doc" || bulkErr.ID != "1" || bulkErr.Status != 429 || bulkErr.Reason != "rejected" {
+		t.Fatalf("expected the BulkError to carry the last response's detail, got %+v", bulkErr)
+	}
+}
+
+func TestBulkIndexrStopDoesNotHangOnSustainedItemRetries(t *testing.T) {
+	bi := NewBulkIndexrWithTransport(alwaysItemFailureTransport{}, 4, 1<<20, DefaultTimeout)
+	bi.SetBackoff(2*time.Second, 2*time.Second, 0)
+	bi.SetItemRetry(1<<20, []int{429})
+	bi.Start()
+
+	if err := bi.Index("idx", "doc", "1", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	go func() {
+		for range bi.errChan {
+		}
+	}()
+
+	stopped := make(chan empty)
+	go func() {
+		bi.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Stop did not return within 1s; retryFailedItems should race doneChan instead of sleeping out its 2s backoff")
+	}
+}
+
+// flaky503Transport answers 503 for the first failFor calls, then 200 OK
+// with no errors, so tests can assert a backoff retry loop recovers once
+// the cluster does.
+type flaky503Transport struct {
+	mu      sync.Mutex
+	failFor int
+	calls   int
+}
+
+func (f *flaky503Transport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	f.mu.Lock()
+	f.calls++
+	shouldFail := f.calls <= f.failFor
+	f.mu.Unlock()
+	if shouldFail {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"took":1,"errors":false,"items":[]}`)),
+	}, nil
+}
+
+func TestBulkIndexrBackoffRecoversAfterTransientRetryableErrors(t *testing.T) {
+	transport := &flaky503Transport{failFor: 2}
+	bi := NewBulkIndexrWithTransport(transport, 4, 1<<20, DefaultTimeout)
+	bi.SetBackoff(time.Millisecond, 5*time.Millisecond, 0)
+	bi.Start()
+
+	errs := make(chan error, 1)
+	go func() {
+		for err := range bi.errChan {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+	}()
+
+	if err := bi.Index("idx", "doc", "", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		transport.mu.Lock()
+		calls := transport.calls
+		transport.mu.Unlock()
+		if calls >= 3 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("expected 2 failed attempts + 1 successful one within the deadline, got %d calls", calls)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	bi.Stop()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("expected the flush to recover once the cluster stopped returning 503, got error: %v", err)
+	default:
+	}
+
+	transport.mu.Lock()
+	calls := transport.calls
+	transport.mu.Unlock()
+	if calls != 3 {
+		t.Fatalf("expected exactly 2 failed attempts + 1 successful one, got %d calls", calls)
+	}
+}
+
+// waitingTransport blocks every Do call until release is closed. The
+// waitForCapacity test below never starts the indexr, so Do is never called
+// there; it sets bi.inFlightRetries directly instead.
+type waitingTransport struct {
+	release chan empty
+}
+
+func (w *waitingTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	io.Copy(ioutil.Discard, body)
+	<-w.release
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"took":1,"errors":false,"items":[]}`)),
+	}, nil
+}
+
+func TestBulkIndexrWaitForCapacityBlocksUntilRetryDrainSignaled(t *testing.T) {
+	bi := NewBulkIndexrWithTransport(&waitingTransport{release: make(chan empty)}, 1, 1<<20, DefaultTimeout)
+
+	// Simulate a send already in flight: at capacity (cap(retryDrain) == 1
+	// since maxNumberOfConns == 1) with no room for another caller.
+	atomic.StoreInt32(&bi.inFlightRetries, int32(cap(bi.retryDrain)))
+
+	done := make(chan empty)
+	go func() {
+		bi.waitForCapacity()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("waitForCapacity returned before capacity was freed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// mirror what sendWithBackoff does once its in-flight attempt
+	// completes: free up a capacity slot and nudge retryDrain so any
+	// blocked waiter re-checks.
+	atomic.AddInt32(&bi.inFlightRetries, -1)
+	bi.retryDrain <- empty{}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForCapacity did not return after retryDrain was signaled")
+	}
+}
+
+func TestBulkIndexrStopDoesNotHangOnSustainedRetryableErrors(t *testing.T) {
+	bi := NewBulkIndexrWithTransport(always503Transport{}, 4, 1<<20, DefaultTimeout)
+	bi.Start()
+
+	if err := bi.Index("idx", "doc", "", false, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Index: %v", err)
+	}
+	bi.Flush()
+
+	// drain the error the retrying flush will eventually report once Stop
+	// cuts its backoff short, so the goroutine below doesn't block on errChan
+	go func() {
+		for range bi.errChan {
+		}
+	}()
+
+	stopped := make(chan empty)
+	go func() {
+		bi.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return within 5s against a sustained 503 with default (unlimited) MaxRetries")
+	}
+}
@@ -20,18 +20,30 @@ type routinePool struct {
 	pool chan empty
 }
 
-func routinePool(maxNumberOfRoutines int) routinePool {
-	return routinePool{
-		pool: make(chan empty,maxNumberOfRoutines),
+// newRoutinePool returns a semaphore of maxNumberOfRoutines tokens: next()
+// acquires one (blocking once all are checked out), add() returns one.
+func newRoutinePool(maxNumberOfRoutines int) routinePool {
+	pool := make(chan empty, maxNumberOfRoutines)
+	for i := 0; i < maxNumberOfRoutines; i++ {
+		pool <- empty{}
 	}
+	return routinePool{pool: pool}
 }
 
 func (rp routinePool) next() {
-	<- rp.pool
+	<-rp.pool
 }
 
 func (rp routinePool) add() {
-	rp.pool<-empty{}
+	rp.pool <- empty{}
+}
+
+// drain blocks until every checked-out token has been returned, i.e. no
+// goroutine is still holding one.
+func (rp routinePool) drain() {
+	for i := 0; i < cap(rp.pool); i++ {
+		<-rp.pool
+	}
 }
 
 func (rp routinePool) stop() {
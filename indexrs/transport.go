@@ -0,0 +1,213 @@
+package goes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport abstracts the HTTP transport bulkIndexr uses to reach
+// Elasticsearch, so production code can plug in auth headers, TLS or an
+// OpenTelemetry-instrumented client, and tests can inject a mock instead of
+// hitting a real cluster.
+type Transport interface {
+	Do(method, path string, body io.Reader) (*http.Response, error)
+}
+
+// defaultDeadAfter is how many consecutive failures (connection errors or
+// 5xx responses) a node must rack up before it is marked dead, so a single
+// transient 500 doesn't take a healthy node out of rotation for the whole
+// cooldown.
+const defaultDeadAfter = 3
+
+// httpTransport is the default Transport: it round-robins across a pool of
+// ES node base URLs (e.g. "http://es1:9200") and, once EnableSniffing is
+// called, periodically refreshes that pool from the cluster itself.
+type httpTransport struct {
+	client *http.Client
+
+	mu           sync.Mutex
+	nodes        []string
+	deadNodes    map[string]time.Time
+	deadCooldown time.Duration
+	failStreak   map[string]int
+	deadAfter    int
+
+	next uint64
+
+	sniffOnce sync.Once
+	closeOnce sync.Once
+	stopSniff chan empty
+}
+
+// NewHTTPTransport builds the default round-robin Transport over nodes.
+// Sniffing is disabled unless EnableSniffing is called.
+func NewHTTPTransport(nodes ...string) *httpTransport {
+	return &httpTransport{
+		client:       http.DefaultClient,
+		nodes:        nodes,
+		deadNodes:    make(map[string]time.Time),
+		deadCooldown: 30 * time.Second,
+		failStreak:   make(map[string]int),
+		deadAfter:    defaultDeadAfter,
+		stopSniff:    make(chan empty),
+	}
+}
+
+// SetDeadThreshold overrides how many consecutive failures a node needs
+// before it is marked dead. n <= 0 is ignored.
+func (t *httpTransport) SetDeadThreshold(n int) {
+	if n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	t.deadAfter = n
+	t.mu.Unlock()
+}
+
+// EnableSniffing starts a background goroutine that issues GET /_nodes/http
+// against the current pool every interval and swaps in the node addresses
+// it finds. Only the first call per transport starts the goroutine; later
+// calls are no-ops. The goroutine runs until Close is called.
+func (t *httpTransport) EnableSniffing(interval time.Duration) {
+	t.sniffOnce.Do(func() {
+		go t.sniffLoop(interval)
+	})
+}
+
+// Close stops the sniffing goroutine, if EnableSniffing was ever called.
+// Safe to call even if sniffing was never enabled, and safe to call more
+// than once.
+func (t *httpTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.stopSniff)
+	})
+	return nil
+}
+
+func (t *httpTransport) Do(method, path string, body io.Reader) (*http.Response, error) {
+	node, err := t.pick()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, node+path, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		t.recordFailure(node)
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		t.recordFailure(node)
+	} else {
+		t.recordSuccess(node)
+	}
+	return resp, nil
+}
+
+// pick round-robins across nodes, skipping ones still in their dead
+// cooldown unless every node is currently marked dead.
+func (t *httpTransport) pick() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.nodes) == 0 {
+		return "", fmt.Errorf("goes: transport has no nodes configured")
+	}
+	now := time.Now()
+	for i := 0; i < len(t.nodes); i++ {
+		node := t.nodes[int(atomic.AddUint64(&t.next, 1)-1)%len(t.nodes)]
+		if deadAt, dead := t.deadNodes[node]; !dead || now.Sub(deadAt) > t.deadCooldown {
+			return node, nil
+		}
+	}
+	// every node is in cooldown; round-robin anyway rather than fail outright
+	return t.nodes[int(atomic.AddUint64(&t.next, 1)-1)%len(t.nodes)], nil
+}
+
+// recordFailure tracks a connection error or 5xx response for node and
+// marks it dead once deadAfter consecutive failures have been seen.
+func (t *httpTransport) recordFailure(node string) {
+	t.mu.Lock()
+	t.failStreak[node]++
+	dead := t.failStreak[node] >= t.deadAfter
+	t.mu.Unlock()
+	if dead {
+		t.markDead(node)
+	}
+}
+
+// recordSuccess clears node's failure streak so isolated errors don't
+// accumulate across otherwise-healthy requests.
+func (t *httpTransport) recordSuccess(node string) {
+	t.mu.Lock()
+	delete(t.failStreak, node)
+	t.mu.Unlock()
+}
+
+func (t *httpTransport) markDead(node string) {
+	t.mu.Lock()
+	t.deadNodes[node] = time.Now()
+	t.failStreak[node] = 0
+	t.mu.Unlock()
+}
+
+func (t *httpTransport) sniffLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.sniff()
+		case <-t.stopSniff:
+			return
+		}
+	}
+}
+
+type nodesHTTPResponse struct {
+	Nodes map[string]struct {
+		HTTP struct {
+			PublishAddress string `json:"publish_address"`
+		} `json:"http"`
+	} `json:"nodes"`
+}
+
+func (t *httpTransport) sniff() {
+	resp, err := t.Do("GET", "/_nodes/http", nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	var parsed nodesHTTPResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return
+	}
+
+	nodes := make([]string, 0, len(parsed.Nodes))
+	for _, n := range parsed.Nodes {
+		if n.HTTP.PublishAddress == "" {
+			continue
+		}
+		nodes = append(nodes, "http://"+n.HTTP.PublishAddress)
+	}
+	if len(nodes) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	t.nodes = nodes
+	t.deadNodes = make(map[string]time.Time)
+	t.mu.Unlock()
+}
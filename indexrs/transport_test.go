@@ -0,0 +1,96 @@
+package goes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler answers every request with status and counts how many
+// requests it has seen, so tests can assert on a transport's retry/failover
+// behavior without a real Elasticsearch cluster.
+type countingHandler struct {
+	status int32
+	count  int32
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.count, 1)
+	w.WriteHeader(int(atomic.LoadInt32(&h.status)))
+}
+
+func TestHTTPTransportMarksNodeDeadOnlyAfterFailureStreak(t *testing.T) {
+	bad := &countingHandler{status: http.StatusServiceUnavailable}
+	badServer := httptest.NewServer(bad)
+	defer badServer.Close()
+
+	good := &countingHandler{status: http.StatusOK}
+	goodServer := httptest.NewServer(good)
+	defer goodServer.Close()
+
+	transport := NewHTTPTransport(badServer.URL, goodServer.URL)
+	transport.SetDeadThreshold(3)
+
+	// A single 503 must not take the node out of rotation: it should still
+	// be picked on the very next round-robin turn.
+	resp, err := transport.Do("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	transport.mu.Lock()
+	_, dead := transport.deadNodes[badServer.URL]
+	transport.mu.Unlock()
+	if dead {
+		t.Fatal("node marked dead after a single failure, want a streak of 3 first")
+	}
+
+	// Bypass pick and Do and record two more failures for the bad node
+	// directly to complete the streak.
+	for i := 0; i < 2; i++ {
+		transport.recordFailure(badServer.URL)
+	}
+
+	transport.mu.Lock()
+	_, dead = transport.deadNodes[badServer.URL]
+	transport.mu.Unlock()
+	if !dead {
+		t.Fatal("expected node to be marked dead after 3 consecutive failures")
+	}
+}
+
+func TestHTTPTransportRecordSuccessResetsStreak(t *testing.T) {
+	transport := NewHTTPTransport("http://node-a")
+	transport.SetDeadThreshold(3)
+
+	transport.recordFailure("http://node-a")
+	transport.recordFailure("http://node-a")
+	transport.recordSuccess("http://node-a")
+	transport.recordFailure("http://node-a")
+
+	transport.mu.Lock()
+	_, dead := transport.deadNodes["http://node-a"]
+	transport.mu.Unlock()
+	if dead {
+		t.Fatal("a success should reset the failure streak, node should not be dead yet")
+	}
+}
+
+func TestHTTPTransportCloseStopsSniffLoop(t *testing.T) {
+	transport := NewHTTPTransport("http://node-a")
+	transport.EnableSniffing(5 * time.Millisecond)
+
+	// let the sniff loop run a couple of ticks before closing
+	time.Sleep(20 * time.Millisecond)
+	if err := transport.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Close should be idempotent and must not panic or block.
+	if err := transport.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}